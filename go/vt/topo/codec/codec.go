@@ -0,0 +1,69 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package codec provides a pluggable, name-addressed serialization for the
+// objects topo stores in zk (or any other backend): SrvShard, SrvKeyspace,
+// and friends. Call sites pick a Codec by name instead of hard-coding a wire
+// format, so an operator can run BSON for compactness or JSON for human
+// debuggability without changing any code that reads or writes topology
+// data.
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/youtube/vitess/go/bson"
+)
+
+// Codec marshals and unmarshals topology objects to and from a wire format.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// BsonCodec is the Codec backed by the project's hand-rolled BSON encoding
+// (the MarshalBson/UnmarshalBson methods on the topo types). It is the
+// default, for compactness and backward compatibility with existing zk data.
+type BsonCodec struct{}
+
+func (BsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return bson.Marshal(v)
+}
+
+func (BsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return bson.Unmarshal(data, v)
+}
+
+// JsonCodec is the Codec backed by encoding/json, useful when an operator
+// wants to read zk contents directly.
+type JsonCodec struct{}
+
+func (JsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+var codecs = map[string]Codec{
+	"bson": BsonCodec{},
+	"json": JsonCodec{},
+}
+
+// Register adds a Codec under name, so it can later be retrieved with Get.
+// Registering under an existing name replaces it.
+func Register(name string, c Codec) {
+	codecs[name] = c
+}
+
+// Get returns the Codec registered under name, or an error if none is.
+func Get(name string) (Codec, error) {
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("topo/codec: no codec registered for %q", name)
+	}
+	return c, nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codec
+
+import "testing"
+
+type sample struct {
+	Name string
+	Age  int
+}
+
+func TestJsonCodecRoundTrip(t *testing.T) {
+	c, err := Get("json")
+	if err != nil {
+		t.Fatalf("Get(json) failed: %v", err)
+	}
+
+	in := sample{Name: "alice", Age: 7}
+	data, err := c.Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal() failed: %v", err)
+	}
+
+	var out sample
+	if err := c.Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal() failed: %v", err)
+	}
+	if out != in {
+		t.Errorf("Unmarshal() = %+v, want %+v", out, in)
+	}
+}
+
+func TestGetKnownCodecs(t *testing.T) {
+	for _, name := range []string{"bson", "json"} {
+		if _, err := Get(name); err != nil {
+			t.Errorf("Get(%q) failed: %v", name, err)
+		}
+	}
+}
+
+func TestGetUnknownCodecErrors(t *testing.T) {
+	if _, err := Get("xml"); err == nil {
+		t.Error("Get(xml) = nil error, want an error for an unregistered codec")
+	}
+}
+
+type spyCodec struct {
+	marshaled *bool
+}
+
+func (s spyCodec) Marshal(v interface{}) ([]byte, error) {
+	*s.marshaled = true
+	return JsonCodec{}.Marshal(v)
+}
+
+func (s spyCodec) Unmarshal(data []byte, v interface{}) error {
+	return JsonCodec{}.Unmarshal(data, v)
+}
+
+func TestRegisterOverridesByName(t *testing.T) {
+	var called bool
+	Register("json", spyCodec{marshaled: &called})
+	defer Register("json", JsonCodec{})
+
+	c, err := Get("json")
+	if err != nil {
+		t.Fatalf("Get(json) failed: %v", err)
+	}
+	if _, err := c.Marshal(sample{Name: "bob"}); err != nil {
+		t.Fatalf("Marshal() failed: %v", err)
+	}
+	if !called {
+		t.Error("Register() did not replace the codec registered under the same name")
+	}
+}
@@ -7,17 +7,25 @@ package topo
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"sort"
 
 	"github.com/youtube/vitess/go/bson"
 	"github.com/youtube/vitess/go/bytes2"
 	"github.com/youtube/vitess/go/vt/key"
+	"github.com/youtube/vitess/go/vt/topo/codec"
 )
 
 // This is the shard name for when the keyrange covers the entire space
 // for unsharded database.
 const SHARD_ZERO = "0"
 
+// DefaultCodecName names the topo/codec.Codec for call sites of
+// Marshal/Unmarshal that don't care about the format, and is what zk has
+// always stored. Marshal/Unmarshal don't fall back to it: they always use
+// the codec name they are given.
+const DefaultCodecName = "bson"
+
 // SrvShard contains a roll-up of the shard in the local namespace.
 // In zk, it is under /zk/<cell>/vt/ns/<keyspace>/<shard>
 type SrvShard struct {
@@ -29,10 +37,192 @@ type SrvShard struct {
 	// for, in this cell only.
 	TabletTypes []TabletType
 
+	// ServingStats carries the latency and QPS aggregates reported by
+	// the serving tablets of each type, for load-aware routing.
+	ServingStats map[TabletType]*ServingStats
+
+	// SchemaVersion is the version of this struct's wire schema, bumped
+	// whenever a field is added or removed. It lets a reader tell which
+	// fields to expect, independent of version which is reserved for CAS.
+	// go/bson has no primitive for capturing an unrecognized key's raw
+	// bytes (Skip discards them), so unlike SchemaVersion, fields written
+	// by a newer peer that this code doesn't know about are dropped
+	// rather than round-tripped; a rolling upgrade can lose them.
+	SchemaVersion int64
+
 	// For atomic updates
 	version int64
 }
 
+// StatAggregate is an online aggregate of a stream of samples, kept as the
+// (n, mean, M2) triple of Welford's algorithm so tablets can contribute
+// updates without shipping raw samples.
+type StatAggregate struct {
+	Count int64
+	Mean  float64
+	M2    float64
+}
+
+// VarPop returns the population variance of the aggregated samples.
+func (a StatAggregate) VarPop() float64 {
+	if a.Count == 0 {
+		return 0
+	}
+	return a.M2 / float64(a.Count)
+}
+
+// VarSamp returns the sample variance of the aggregated samples.
+func (a StatAggregate) VarSamp() float64 {
+	if a.Count < 2 {
+		return 0
+	}
+	return a.M2 / float64(a.Count-1)
+}
+
+// StdDev returns the sample standard deviation of the aggregated samples.
+func (a StatAggregate) StdDev() float64 {
+	return math.Sqrt(a.VarSamp())
+}
+
+// Combine rolls up two aggregates computed over disjoint sample sets using
+// the parallel-variance recurrence, so a SrvShard can merge per-tablet
+// aggregates without access to the underlying samples.
+func (a StatAggregate) Combine(b StatAggregate) StatAggregate {
+	if a.Count == 0 {
+		return b
+	}
+	if b.Count == 0 {
+		return a
+	}
+	na, nb := float64(a.Count), float64(b.Count)
+	n := na + nb
+	delta := b.Mean - a.Mean
+	return StatAggregate{
+		Count: a.Count + b.Count,
+		Mean:  (na*a.Mean + nb*b.Mean) / n,
+		M2:    a.M2 + b.M2 + delta*delta*na*nb/n,
+	}
+}
+
+func (a *StatAggregate) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
+	bson.EncodeOptionalPrefix(buf, bson.Object, key)
+	lenWriter := bson.NewLenWriter(buf)
+
+	bson.EncodeInt64(buf, "Count", a.Count)
+	bson.EncodeFloat64(buf, "Mean", a.Mean)
+	bson.EncodeFloat64(buf, "M2", a.M2)
+
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+func (a *StatAggregate) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+	bson.VerifyObject(kind)
+	bson.Next(buf, 4)
+
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		keyName := bson.ReadCString(buf)
+		switch keyName {
+		case "Count":
+			a.Count = bson.DecodeInt64(buf, kind)
+		case "Mean":
+			a.Mean = bson.DecodeFloat64(buf, kind)
+		case "M2":
+			a.M2 = bson.DecodeFloat64(buf, kind)
+		default:
+			bson.Skip(buf, kind)
+		}
+		kind = bson.NextByte(buf)
+	}
+}
+
+// ServingStats is the per-TabletType roll-up of the latency and QPS
+// aggregates reported by the serving tablets of a SrvShard.
+type ServingStats struct {
+	Latency StatAggregate
+	Qps     StatAggregate
+}
+
+// Score returns latency mean + k*stddev, the value the vtgate shard picker
+// uses to rank candidate replicas; lower scores are preferred.
+func (ss *ServingStats) Score(k float64) float64 {
+	return ss.Latency.Mean + k*ss.Latency.StdDev()
+}
+
+func (ss *ServingStats) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
+	bson.EncodeOptionalPrefix(buf, bson.Object, key)
+	lenWriter := bson.NewLenWriter(buf)
+
+	ss.Latency.MarshalBson(buf, "Latency")
+	ss.Qps.MarshalBson(buf, "Qps")
+
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+func (ss *ServingStats) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+	bson.VerifyObject(kind)
+	bson.Next(buf, 4)
+
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		keyName := bson.ReadCString(buf)
+		switch keyName {
+		case "Latency":
+			ss.Latency.UnmarshalBson(buf, kind)
+		case "Qps":
+			ss.Qps.UnmarshalBson(buf, kind)
+		default:
+			bson.Skip(buf, kind)
+		}
+		kind = bson.NextByte(buf)
+	}
+}
+
+// EncodeServingStatsMap encodes the per-TabletType ServingStats roll-up,
+// next to EncodeTabletTypeArray.
+func EncodeServingStatsMap(buf *bytes2.ChunkedWriter, name string, values map[TabletType]*ServingStats) {
+	if len(values) == 0 {
+		bson.EncodePrefix(buf, bson.Null, name)
+	} else {
+		bson.EncodePrefix(buf, bson.Object, name)
+		lenWriter := bson.NewLenWriter(buf)
+		for k, v := range values {
+			v.MarshalBson(buf, string(k))
+		}
+		buf.WriteByte(0)
+		lenWriter.RecordLen()
+	}
+}
+
+// DecodeServingStatsMap decodes a map encoded by EncodeServingStatsMap.
+func DecodeServingStatsMap(buf *bytes.Buffer, kind byte) map[TabletType]*ServingStats {
+	switch kind {
+	case bson.Object:
+		// valid
+	case bson.Null:
+		return nil
+	default:
+		panic(bson.NewBsonError("Unexpected data type %v for ServingStats map", kind))
+	}
+
+	bson.Next(buf, 4)
+	values := make(map[TabletType]*ServingStats)
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		keyName := bson.ReadCString(buf)
+		if kind != bson.Object {
+			panic(bson.NewBsonError("Unexpected data type %v for ServingStats map", kind))
+		}
+		ss := &ServingStats{}
+		ss.UnmarshalBson(buf, kind)
+		values[TabletType(keyName)] = ss
+		kind = bson.NextByte(buf)
+	}
+	return values
+}
+
 type SrvShardArray []SrvShard
 
 func (sa SrvShardArray) Len() int { return len(sa) }
@@ -53,6 +243,27 @@ func NewSrvShard(version int64) *SrvShard {
 	}
 }
 
+// Marshal serializes ss with the named topo/codec.Codec (see
+// DefaultCodecName), so a zk write path can pick BSON for compactness or
+// JSON for human debuggability without touching ss's own encode/decode
+// methods.
+func (ss *SrvShard) Marshal(codecName string) ([]byte, error) {
+	c, err := codec.Get(codecName)
+	if err != nil {
+		return nil, err
+	}
+	return c.Marshal(ss)
+}
+
+// Unmarshal deserializes data into ss with the named topo/codec.Codec.
+func (ss *SrvShard) Unmarshal(codecName string, data []byte) error {
+	c, err := codec.Get(codecName)
+	if err != nil {
+		return err
+	}
+	return c.Unmarshal(data, ss)
+}
+
 func EncodeTabletTypeArray(buf *bytes2.ChunkedWriter, name string, values []TabletType) {
 	if len(values) == 0 {
 		bson.EncodePrefix(buf, bson.Null, name)
@@ -98,6 +309,8 @@ func (ss *SrvShard) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
 	ss.KeyRange.MarshalBson(buf, "KeyRange")
 	EncodeTabletTypeArray(buf, "ServedTypes", ss.ServedTypes)
 	EncodeTabletTypeArray(buf, "TabletTypes", ss.TabletTypes)
+	EncodeServingStatsMap(buf, "ServingStats", ss.ServingStats)
+	bson.EncodeInt64(buf, "SchemaVersion", ss.SchemaVersion)
 
 	buf.WriteByte(0)
 	lenWriter.RecordLen()
@@ -118,6 +331,10 @@ func (ss *SrvShard) UnmarshalBson(buf *bytes.Buffer, kind byte) {
 			ss.ServedTypes = DecodeTabletTypeArray(buf, kind)
 		case "TabletTypes":
 			ss.TabletTypes = DecodeTabletTypeArray(buf, kind)
+		case "ServingStats":
+			ss.ServingStats = DecodeServingStatsMap(buf, kind)
+		case "SchemaVersion":
+			ss.SchemaVersion = bson.DecodeInt64(buf, kind)
 		default:
 			bson.Skip(buf, kind)
 		}
@@ -139,6 +356,32 @@ type KeyspacePartition struct {
 	Shards []SrvShard
 }
 
+// PreferredShard is vtgate's shard picker: among the shards in kp that
+// overlap kr and have reported ServingStats for tabletType, it returns the
+// one with the lowest latency mean+k*stddev score, preferring the most
+// consistently fast replica over round-robin. It returns nil if no shard in
+// kp overlaps kr or has reported stats for tabletType.
+func (kp *KeyspacePartition) PreferredShard(tabletType TabletType, kr key.KeyRange, k float64) *SrvShard {
+	var best *SrvShard
+	var bestScore float64
+	for i := range kp.Shards {
+		ss := &kp.Shards[i]
+		if !keyRangesOverlap(ss.KeyRange, kr) {
+			continue
+		}
+		stats, ok := ss.ServingStats[tabletType]
+		if !ok {
+			continue
+		}
+		score := stats.Score(k)
+		if best == nil || score < bestScore {
+			best = ss
+			bestScore = score
+		}
+	}
+	return best
+}
+
 func EncodeSrvShardArray(buf *bytes2.ChunkedWriter, name string, values []SrvShard) {
 	if len(values) == 0 {
 		bson.EncodePrefix(buf, bson.Null, name)
@@ -225,18 +468,229 @@ type SrvKeyspace struct {
 	// Copied from Keyspace
 	ShardingColumnName string
 	ShardingColumnType key.KeyspaceIdType
-	ServedFrom         map[TabletType]string
+	ServedFrom         map[TabletType]*ServedFromEntry
+
+	// SchemaVersion is the version of this struct's wire schema, bumped
+	// whenever a field is added or removed, independent of version which
+	// is reserved for CAS. See SrvShard.SchemaVersion for why this, and
+	// not a generic unknown-field bag, is the forward-compat mechanism:
+	// go/bson has no primitive to capture an unrecognized key's raw
+	// bytes.
+	SchemaVersion int64
 
 	// For atomic updates
 	version int64
 }
 
+// ServedFromMode describes how vtgate should treat queries that get
+// redirected to another keyspace by a ServedFromEntry.
+type ServedFromMode string
+
+const (
+	// SERVED_FROM_MODE_TRANSPARENT forwards the query unchanged to the
+	// shard of the destination keyspace that owns the matching key
+	// range, the same way a VIEW with algorithm TEMPTABLE re-evaluates
+	// against the underlying table.
+	SERVED_FROM_MODE_TRANSPARENT = ServedFromMode("transparent")
+
+	// SERVED_FROM_MODE_MERGED lets the destination keyspace answer using
+	// its own partitioning, potentially combining rows from several of
+	// its shards, the way a MERGE-algorithm VIEW does.
+	SERVED_FROM_MODE_MERGED = ServedFromMode("merged")
+)
+
+// ServedFromCheckOption mirrors a VIEW's CHECK OPTION: it controls whether
+// vtgate must verify that a redirected query's key range still falls inside
+// the destination keyspace's served key ranges before forwarding it.
+type ServedFromCheckOption string
+
+const (
+	// CHECK_OPTION_NONE performs no validation: a write that lands on a
+	// shard the destination keyspace doesn't serve will be silently
+	// dropped by the destination, just like a bare VIEW with no CHECK
+	// OPTION allows rows that don't satisfy the view's WHERE clause.
+	CHECK_OPTION_NONE = ServedFromCheckOption("")
+
+	// CHECK_OPTION_LOCAL rejects the query if it doesn't fall within the
+	// destination keyspace's own served key ranges.
+	CHECK_OPTION_LOCAL = ServedFromCheckOption("local")
+
+	// CHECK_OPTION_CASCADED behaves like CHECK_OPTION_LOCAL, and in
+	// addition requires the destination keyspace to satisfy the check
+	// of any ServedFromEntry it in turn redirects through.
+	CHECK_OPTION_CASCADED = ServedFromCheckOption("cascaded")
+)
+
+// ServedFromEntry describes a redirection of one TabletType's traffic in
+// this keyspace to be served from a different keyspace, analogous to the
+// Algorithm / Definer / CheckOption fields recorded for VIEWs.
+type ServedFromEntry struct {
+	// Keyspace is the name of the keyspace that actually serves the data.
+	Keyspace string
+
+	// Mode determines how vtgate forwards queries to Keyspace.
+	Mode ServedFromMode
+
+	// Definer records who (or what process) created this redirection,
+	// for auditability.
+	Definer string
+
+	// CheckOption controls whether vtgate validates the destination
+	// keyspace's served key ranges before forwarding.
+	CheckOption ServedFromCheckOption
+}
+
+// CheckKeyRange returns an error if CheckOption requires it and kr is not
+// covered by destPartition per sfe.Mode: SERVED_FROM_MODE_TRANSPARENT
+// requires a single destination shard to fully contain kr, the way it
+// forwards the query to one shard unchanged; SERVED_FROM_MODE_MERGED allows
+// kr to be stitched together out of several adjacent destination shards. A
+// redirected write that fails this check must be rejected by the caller
+// instead of being forwarded to a destination that cannot serve it.
+func (sfe *ServedFromEntry) CheckKeyRange(kr key.KeyRange, destPartition *KeyspacePartition) error {
+	if sfe.CheckOption == CHECK_OPTION_NONE {
+		return nil
+	}
+	if destPartition == nil {
+		return fmt.Errorf("ServedFrom(%v) has CheckOption %v but destination keyspace %v has no partition to check against", sfe.Keyspace, sfe.CheckOption, sfe.Keyspace)
+	}
+
+	var ok bool
+	if sfe.Mode == SERVED_FROM_MODE_MERGED {
+		ok = coveredByShards(kr, destPartition.Shards)
+	} else {
+		ok = coveredBySingleShard(kr, destPartition.Shards)
+	}
+	if ok {
+		return nil
+	}
+	return fmt.Errorf("ServedFrom(%v) CheckOption %v rejected query with key range %v-%v: not served by destination keyspace %v", sfe.Keyspace, sfe.CheckOption, kr.Start.Hex(), kr.End.Hex(), sfe.Keyspace)
+}
+
+// coveredBySingleShard returns whether one of shards fully contains kr on
+// its own, as required by a SERVED_FROM_MODE_TRANSPARENT redirect.
+func coveredBySingleShard(kr key.KeyRange, shards []SrvShard) bool {
+	for _, ss := range shards {
+		if kr.Start < ss.KeyRange.Start {
+			continue
+		}
+		if ss.KeyRange.End == "" {
+			return true
+		}
+		if kr.End != "" && kr.End <= ss.KeyRange.End {
+			return true
+		}
+	}
+	return false
+}
+
+// coveredByShards returns whether kr is fully covered end-to-end by the
+// union of shards' key ranges. A SERVED_FROM_MODE_MERGED redirection may
+// span several adjacent destination shards, so coverage is accumulated
+// across shards sorted by KeyRange.Start rather than tested one shard at a
+// time.
+func coveredByShards(kr key.KeyRange, shards []SrvShard) bool {
+	sorted := make(SrvShardArray, len(shards))
+	copy(sorted, shards)
+	sorted.Sort()
+
+	covered := kr.Start
+	for _, ss := range sorted {
+		if ss.KeyRange.Start > covered {
+			// Gap between the covered frontier and this shard: since
+			// shards are sorted by Start, no later shard can close it.
+			break
+		}
+		if ss.KeyRange.End == "" {
+			// This shard covers everything from here to the end of the
+			// keyspace, which covers any kr.End including unbounded.
+			return true
+		}
+		if ss.KeyRange.End > covered {
+			covered = ss.KeyRange.End
+		}
+		if kr.End != "" && covered >= kr.End {
+			return true
+		}
+	}
+	return false
+}
+
+// keyRangesOverlap returns whether a and b share any part of the keyspace,
+// treating an empty Start/End as unbounded in that direction.
+func keyRangesOverlap(a, b key.KeyRange) bool {
+	if a.End != "" && b.Start >= a.End {
+		return false
+	}
+	if b.End != "" && a.Start >= b.End {
+		return false
+	}
+	return true
+}
+
+func (sfe *ServedFromEntry) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
+	bson.EncodeOptionalPrefix(buf, bson.Object, key)
+	lenWriter := bson.NewLenWriter(buf)
+
+	bson.EncodeString(buf, "Keyspace", sfe.Keyspace)
+	bson.EncodeString(buf, "Mode", string(sfe.Mode))
+	bson.EncodeString(buf, "Definer", sfe.Definer)
+	bson.EncodeString(buf, "CheckOption", string(sfe.CheckOption))
+
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+func (sfe *ServedFromEntry) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+	bson.VerifyObject(kind)
+	bson.Next(buf, 4)
+
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		keyName := bson.ReadCString(buf)
+		switch keyName {
+		case "Keyspace":
+			sfe.Keyspace = bson.DecodeString(buf, kind)
+		case "Mode":
+			sfe.Mode = ServedFromMode(bson.DecodeString(buf, kind))
+		case "Definer":
+			sfe.Definer = bson.DecodeString(buf, kind)
+		case "CheckOption":
+			sfe.CheckOption = ServedFromCheckOption(bson.DecodeString(buf, kind))
+		default:
+			bson.Skip(buf, kind)
+		}
+		kind = bson.NextByte(buf)
+	}
+}
+
 func NewSrvKeyspace(version int64) *SrvKeyspace {
 	return &SrvKeyspace{
 		version: version,
 	}
 }
 
+// Marshal serializes sk with the named topo/codec.Codec (see
+// DefaultCodecName), so a zk write path can pick BSON for compactness or
+// JSON for human debuggability without touching sk's own encode/decode
+// methods.
+func (sk *SrvKeyspace) Marshal(codecName string) ([]byte, error) {
+	c, err := codec.Get(codecName)
+	if err != nil {
+		return nil, err
+	}
+	return c.Marshal(sk)
+}
+
+// Unmarshal deserializes data into sk with the named topo/codec.Codec.
+func (sk *SrvKeyspace) Unmarshal(codecName string, data []byte) error {
+	c, err := codec.Get(codecName)
+	if err != nil {
+		return err
+	}
+	return c.Unmarshal(data, sk)
+}
+
 func EncodeKeyspacePartitionMap(buf *bytes2.ChunkedWriter, name string, values map[TabletType]*KeyspacePartition) {
 	if len(values) == 0 {
 		bson.EncodePrefix(buf, bson.Null, name)
@@ -277,17 +731,22 @@ func DecodeKeyspacePartitionMap(buf *bytes.Buffer, kind byte) map[TabletType]*Ke
 	return values
 }
 
-func EncodeServedFrom(buf *bytes2.ChunkedWriter, name string, servedFrom map[TabletType]string) {
+func EncodeServedFrom(buf *bytes2.ChunkedWriter, name string, servedFrom map[TabletType]*ServedFromEntry) {
 	bson.EncodePrefix(buf, bson.Object, name)
 	lenWriter := bson.NewLenWriter(buf)
 	for k, v := range servedFrom {
-		bson.EncodeString(buf, string(k), v)
+		v.MarshalBson(buf, string(k))
 	}
 	buf.WriteByte(0)
 	lenWriter.RecordLen()
 }
 
-func DecodeServedFrom(buf *bytes.Buffer, kind byte) map[TabletType]string {
+// DecodeServedFrom reads the ServedFrom map. For backward compatibility, an
+// older peer may have written the pre-ServedFromEntry form, a bare string
+// naming the destination keyspace: that decodes into a ServedFromEntry with
+// SERVED_FROM_MODE_TRANSPARENT and CHECK_OPTION_NONE, matching prior
+// behavior.
+func DecodeServedFrom(buf *bytes.Buffer, kind byte) map[TabletType]*ServedFromEntry {
 	switch kind {
 	case bson.Object:
 		//valid
@@ -297,13 +756,22 @@ func DecodeServedFrom(buf *bytes.Buffer, kind byte) map[TabletType]string {
 		panic(bson.NewBsonError("Unexpected data type %v for ServedFrom map", kind))
 	}
 
-	servedFrom := make(map[TabletType]string)
+	servedFrom := make(map[TabletType]*ServedFromEntry)
 	bson.Next(buf, 4)
 	for kind = bson.NextByte(buf); kind != bson.EOO; kind = bson.NextByte(buf) {
 		keyName := bson.ReadCString(buf)
 		switch kind {
 		case bson.String, bson.Binary:
-			servedFrom[TabletType(keyName)] = bson.DecodeString(buf, kind)
+			servedFrom[TabletType(keyName)] = &ServedFromEntry{
+				Keyspace: bson.DecodeString(buf, kind),
+				Mode:     SERVED_FROM_MODE_TRANSPARENT,
+			}
+		case bson.Object:
+			sfe := &ServedFromEntry{}
+			sfe.UnmarshalBson(buf, kind)
+			servedFrom[TabletType(keyName)] = sfe
+		default:
+			bson.Skip(buf, kind)
 		}
 	}
 	return servedFrom
@@ -321,6 +789,7 @@ func (sk *SrvKeyspace) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
 	bson.EncodeString(buf, "ShardingColumnName", sk.ShardingColumnName)
 	bson.EncodeString(buf, "ShardingColumnType", string(sk.ShardingColumnType))
 	EncodeServedFrom(buf, "ServedFrom", sk.ServedFrom)
+	bson.EncodeInt64(buf, "SchemaVersion", sk.SchemaVersion)
 
 	buf.WriteByte(0)
 	lenWriter.RecordLen()
@@ -346,9 +815,61 @@ func (sk *SrvKeyspace) UnmarshalBson(buf *bytes.Buffer, kind byte) {
 			sk.ShardingColumnType = key.KeyspaceIdType(bson.DecodeString(buf, kind))
 		case "ServedFrom":
 			sk.ServedFrom = DecodeServedFrom(buf, kind)
+		case "SchemaVersion":
+			sk.SchemaVersion = bson.DecodeInt64(buf, kind)
 		default:
 			bson.Skip(buf, kind)
 		}
 		kind = bson.NextByte(buf)
 	}
 }
+
+// ServedFromResolver fetches the current SrvKeyspace for a keyspace by
+// name. CheckServedFromRedirect calls it to follow a CHECK_OPTION_CASCADED
+// chain beyond the immediate destination keyspace, since this package has
+// no topology server connection of its own to do that lookup.
+type ServedFromResolver func(keyspace string) (*SrvKeyspace, error)
+
+// CheckServedFromRedirect is the routing-side enforcement point for
+// ServedFrom: before vtgate forwards a query for tabletType with key range
+// kr, it calls this to make sure the redirect (if any) doesn't drop the
+// write on the floor. destKeyspace is the SrvKeyspace of the keyspace the
+// ServedFrom entry points at, or nil if it isn't known locally. It returns
+// nil if there is no redirect for tabletType, or if the redirect's
+// CheckOption is satisfied; otherwise the query must be rejected rather
+// than forwarded.
+//
+// When entry.CheckOption is CHECK_OPTION_CASCADED and destKeyspace itself
+// redirects tabletType onward, the check recurses into that next hop using
+// resolve to fetch its SrvKeyspace; resolve may be nil if destKeyspace is
+// known not to cascade further.
+func (sk *SrvKeyspace) CheckServedFromRedirect(tabletType TabletType, kr key.KeyRange, destKeyspace *SrvKeyspace, resolve ServedFromResolver) error {
+	entry, ok := sk.ServedFrom[tabletType]
+	if !ok {
+		return nil
+	}
+	var destPartition *KeyspacePartition
+	if destKeyspace != nil {
+		destPartition = destKeyspace.Partitions[tabletType]
+	}
+	if err := entry.CheckKeyRange(kr, destPartition); err != nil {
+		return err
+	}
+	if entry.CheckOption != CHECK_OPTION_CASCADED || destKeyspace == nil {
+		return nil
+	}
+	nextEntry, ok := destKeyspace.ServedFrom[tabletType]
+	if !ok {
+		// destKeyspace doesn't redirect tabletType any further, so there's
+		// nothing left to cascade into.
+		return nil
+	}
+	if resolve == nil {
+		return fmt.Errorf("ServedFrom(%v) CheckOption %v requires checking %v's own ServedFrom(%v), but no resolver was given to fetch it", entry.Keyspace, entry.CheckOption, entry.Keyspace, nextEntry.Keyspace)
+	}
+	nextDest, err := resolve(nextEntry.Keyspace)
+	if err != nil {
+		return err
+	}
+	return destKeyspace.CheckServedFromRedirect(tabletType, kr, nextDest, resolve)
+}
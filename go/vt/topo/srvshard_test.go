@@ -0,0 +1,337 @@
+// Copyright 2012, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package topo
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/youtube/vitess/go/vt/key"
+)
+
+// aggregateOf replays Welford's algorithm over samples, the same way a
+// tablet would build up a StatAggregate to report.
+func aggregateOf(samples []float64) StatAggregate {
+	var a StatAggregate
+	for _, x := range samples {
+		a.Count++
+		delta := x - a.Mean
+		a.Mean += delta / float64(a.Count)
+		a.M2 += delta * (x - a.Mean)
+	}
+	return a
+}
+
+func TestStatAggregateCombine(t *testing.T) {
+	samples := []float64{2, 4, 4, 4, 5, 5, 7, 9}
+	full := aggregateOf(samples)
+
+	for _, split := range []int{1, 3, 4, 7} {
+		a := aggregateOf(samples[:split])
+		b := aggregateOf(samples[split:])
+		got := a.Combine(b)
+
+		if got.Count != full.Count {
+			t.Errorf("split %v: Count = %v, want %v", split, got.Count, full.Count)
+		}
+		if math.Abs(got.Mean-full.Mean) > 1e-9 {
+			t.Errorf("split %v: Mean = %v, want %v", split, got.Mean, full.Mean)
+		}
+		if math.Abs(got.M2-full.M2) > 1e-9 {
+			t.Errorf("split %v: M2 = %v, want %v", split, got.M2, full.M2)
+		}
+	}
+}
+
+func TestStatAggregateVariance(t *testing.T) {
+	a := StatAggregate{Count: 4, Mean: 5, M2: 12}
+	if got := a.VarPop(); math.Abs(got-3) > 1e-9 {
+		t.Errorf("VarPop() = %v, want 3", got)
+	}
+	if got := a.VarSamp(); math.Abs(got-4) > 1e-9 {
+		t.Errorf("VarSamp() = %v, want 4", got)
+	}
+
+	var zero StatAggregate
+	if got := zero.VarPop(); got != 0 {
+		t.Errorf("zero.VarPop() = %v, want 0", got)
+	}
+	if got := zero.VarSamp(); got != 0 {
+		t.Errorf("zero.VarSamp() = %v, want 0", got)
+	}
+
+	one := StatAggregate{Count: 1, Mean: 5}
+	if got := one.VarSamp(); got != 0 {
+		t.Errorf("single-sample.VarSamp() = %v, want 0", got)
+	}
+}
+
+func TestCheckKeyRange(t *testing.T) {
+	kr := func(start, end string) key.KeyRange {
+		return key.KeyRange{Start: key.KeyspaceId(start), End: key.KeyspaceId(end)}
+	}
+
+	cases := []struct {
+		name        string
+		checkOption ServedFromCheckOption
+		mode        ServedFromMode
+		kr          key.KeyRange
+		destShards  []SrvShard
+		wantErr     bool
+	}{
+		{
+			name:        "no check option needs no coverage",
+			checkOption: CHECK_OPTION_NONE,
+			kr:          kr("a", "z"),
+			destShards:  nil,
+			wantErr:     false,
+		},
+		{
+			name:        "single shard fully covers",
+			checkOption: CHECK_OPTION_LOCAL,
+			mode:        SERVED_FROM_MODE_TRANSPARENT,
+			kr:          kr("c", "f"),
+			destShards:  []SrvShard{{KeyRange: kr("a", "z")}},
+			wantErr:     false,
+		},
+		{
+			name:        "gap between shards is rejected",
+			checkOption: CHECK_OPTION_LOCAL,
+			mode:        SERVED_FROM_MODE_MERGED,
+			kr:          kr("a", "z"),
+			destShards:  []SrvShard{{KeyRange: kr("a", "c")}, {KeyRange: kr("f", "z")}},
+			wantErr:     true,
+		},
+		{
+			name:        "merged mode stitches coverage across adjacent shards",
+			checkOption: CHECK_OPTION_LOCAL,
+			mode:        SERVED_FROM_MODE_MERGED,
+			kr:          kr("a", "z"),
+			destShards:  []SrvShard{{KeyRange: kr("m", "z")}, {KeyRange: kr("a", "m")}},
+			wantErr:     false,
+		},
+		{
+			name:        "transparent mode rejects a range spanning shard boundaries",
+			checkOption: CHECK_OPTION_LOCAL,
+			mode:        SERVED_FROM_MODE_TRANSPARENT,
+			kr:          kr("a", "z"),
+			destShards:  []SrvShard{{KeyRange: kr("m", "z")}, {KeyRange: kr("a", "m")}},
+			wantErr:     true,
+		},
+		{
+			name:        "unbounded query range against a finite shard is rejected",
+			checkOption: CHECK_OPTION_LOCAL,
+			mode:        SERVED_FROM_MODE_MERGED,
+			kr:          kr("a", ""),
+			destShards:  []SrvShard{{KeyRange: kr("a", "m")}},
+			wantErr:     true,
+		},
+		{
+			name:        "unbounded query range covered by an unbounded shard",
+			checkOption: CHECK_OPTION_LOCAL,
+			mode:        SERVED_FROM_MODE_TRANSPARENT,
+			kr:          kr("a", ""),
+			destShards:  []SrvShard{{KeyRange: kr("a", "")}},
+			wantErr:     false,
+		},
+		{
+			name:        "no destination partition is rejected",
+			checkOption: CHECK_OPTION_CASCADED,
+			kr:          kr("a", "z"),
+			destShards:  nil,
+			wantErr:     true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sfe := &ServedFromEntry{Keyspace: "dest", Mode: tc.mode, CheckOption: tc.checkOption}
+			var part *KeyspacePartition
+			if tc.destShards != nil {
+				part = &KeyspacePartition{Shards: tc.destShards}
+			}
+			err := sfe.CheckKeyRange(tc.kr, part)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("CheckKeyRange() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckServedFromRedirectCascades(t *testing.T) {
+	kr := func(start, end string) key.KeyRange {
+		return key.KeyRange{Start: key.KeyspaceId(start), End: key.KeyspaceId(end)}
+	}
+	full := kr("", "")
+	tabletType := TabletType("replica")
+
+	// a redirects to b (cascaded, covered); b in turn redirects to c
+	// (cascaded, NOT covered). The cascade must surface c's rejection.
+	c := &SrvKeyspace{
+		Partitions: map[TabletType]*KeyspacePartition{
+			tabletType: {Shards: []SrvShard{{KeyRange: kr("", "m")}}},
+		},
+	}
+	b := &SrvKeyspace{
+		Partitions: map[TabletType]*KeyspacePartition{
+			tabletType: {Shards: []SrvShard{{KeyRange: full}}},
+		},
+		ServedFrom: map[TabletType]*ServedFromEntry{
+			tabletType: {Keyspace: "c", Mode: SERVED_FROM_MODE_TRANSPARENT, CheckOption: CHECK_OPTION_CASCADED},
+		},
+	}
+	a := &SrvKeyspace{
+		ServedFrom: map[TabletType]*ServedFromEntry{
+			tabletType: {Keyspace: "b", Mode: SERVED_FROM_MODE_TRANSPARENT, CheckOption: CHECK_OPTION_CASCADED},
+		},
+	}
+
+	resolve := func(keyspace string) (*SrvKeyspace, error) {
+		switch keyspace {
+		case "b":
+			return b, nil
+		case "c":
+			return c, nil
+		}
+		return nil, fmt.Errorf("unknown keyspace %v", keyspace)
+	}
+
+	if err := a.CheckServedFromRedirect(tabletType, full, b, resolve); err == nil {
+		t.Errorf("CheckServedFromRedirect() = nil, want an error cascaded from b's redirect to c, which doesn't cover an unbounded range")
+	}
+
+	// Once c covers the full range, the cascade succeeds end-to-end.
+	c.Partitions[tabletType].Shards = []SrvShard{{KeyRange: full}}
+	if err := a.CheckServedFromRedirect(tabletType, full, b, resolve); err != nil {
+		t.Errorf("CheckServedFromRedirect() = %v, want nil once c covers the full range", err)
+	}
+
+	// Without a resolver, a CASCADED redirect into a further-redirecting
+	// destination must be rejected rather than silently accepted.
+	if err := a.CheckServedFromRedirect(tabletType, full, b, nil); err == nil {
+		t.Errorf("CheckServedFromRedirect() = nil, want an error when no resolver is given to follow the cascade")
+	}
+}
+
+func TestKeyspacePartitionPreferredShard(t *testing.T) {
+	kr := func(start, end string) key.KeyRange {
+		return key.KeyRange{Start: key.KeyspaceId(start), End: key.KeyspaceId(end)}
+	}
+	replica := TabletType("replica")
+
+	part := &KeyspacePartition{
+		Shards: []SrvShard{
+			{
+				KeyRange: kr("a", "m"),
+				ServingStats: map[TabletType]*ServingStats{
+					replica: {Latency: StatAggregate{Count: 10, Mean: 50}},
+				},
+			},
+			{
+				KeyRange: kr("m", "z"),
+				ServingStats: map[TabletType]*ServingStats{
+					replica: {Latency: StatAggregate{Count: 10, Mean: 20}},
+				},
+			},
+			{
+				// Outside the query range: must not be picked even though
+				// it has the lowest latency of all three.
+				KeyRange: kr("z", ""),
+				ServingStats: map[TabletType]*ServingStats{
+					replica: {Latency: StatAggregate{Count: 10, Mean: 5}},
+				},
+			},
+		},
+	}
+
+	got := part.PreferredShard(replica, kr("a", "z"), 0)
+	if got == nil || got.KeyRange.Start != key.KeyspaceId("m") {
+		t.Errorf("PreferredShard() = %+v, want the shard starting at \"m\"", got)
+	}
+
+	none := &KeyspacePartition{Shards: []SrvShard{{KeyRange: kr("a", "z")}}}
+	if got := none.PreferredShard(replica, kr("a", "z"), 0); got != nil {
+		t.Errorf("PreferredShard() = %+v, want nil when no shard has reported stats", got)
+	}
+}
+
+func TestSrvShardCodecRoundTrip(t *testing.T) {
+	kr := func(start, end string) key.KeyRange {
+		return key.KeyRange{Start: key.KeyspaceId(start), End: key.KeyspaceId(end)}
+	}
+	orig := SrvShard{
+		KeyRange:    kr("a", "m"),
+		ServedTypes: []TabletType{"master"},
+		TabletTypes: []TabletType{"master", "replica"},
+		ServingStats: map[TabletType]*ServingStats{
+			"replica": {
+				Latency: StatAggregate{Count: 5, Mean: 12.5, M2: 3},
+				Qps:     StatAggregate{Count: 5, Mean: 100},
+			},
+		},
+		SchemaVersion: 2,
+	}
+
+	data, err := orig.Marshal("json")
+	if err != nil {
+		t.Fatalf("Marshal(json) failed: %v", err)
+	}
+
+	var got SrvShard
+	if err := got.Unmarshal("json", data); err != nil {
+		t.Fatalf("Unmarshal(json) failed: %v", err)
+	}
+	if !reflect.DeepEqual(orig, got) {
+		t.Errorf("Unmarshal(json) = %+v, want %+v", got, orig)
+	}
+}
+
+func TestSrvKeyspaceCodecRoundTrip(t *testing.T) {
+	kr := func(start, end string) key.KeyRange {
+		return key.KeyRange{Start: key.KeyspaceId(start), End: key.KeyspaceId(end)}
+	}
+	orig := SrvKeyspace{
+		Partitions: map[TabletType]*KeyspacePartition{
+			"replica": {Shards: []SrvShard{{KeyRange: kr("", "")}}},
+		},
+		TabletTypes:        []TabletType{"master", "replica"},
+		ShardingColumnName: "user_id",
+		ShardingColumnType: key.KeyspaceIdType("uint64"),
+		ServedFrom: map[TabletType]*ServedFromEntry{
+			"rdonly": {
+				Keyspace:    "other_keyspace",
+				Mode:        SERVED_FROM_MODE_MERGED,
+				Definer:     "migration-tool",
+				CheckOption: CHECK_OPTION_CASCADED,
+			},
+		},
+		SchemaVersion: 3,
+	}
+
+	data, err := orig.Marshal("json")
+	if err != nil {
+		t.Fatalf("Marshal(json) failed: %v", err)
+	}
+
+	var got SrvKeyspace
+	if err := got.Unmarshal("json", data); err != nil {
+		t.Fatalf("Unmarshal(json) failed: %v", err)
+	}
+	if !reflect.DeepEqual(orig, got) {
+		t.Errorf("Unmarshal(json) = %+v, want %+v", got, orig)
+	}
+}
+
+func TestMarshalUnknownCodecErrors(t *testing.T) {
+	var ss SrvShard
+	if _, err := ss.Marshal("xml"); err == nil {
+		t.Error("Marshal(xml) = nil error, want an error for an unregistered codec")
+	}
+	if err := ss.Unmarshal("xml", nil); err == nil {
+		t.Error("Unmarshal(xml) = nil error, want an error for an unregistered codec")
+	}
+}